@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/peer"
+
+	"vitess.io/vitess/go/acl"
+
+	binlogdatapb "vitess.io/vitess/go/vt/proto/binlogdata"
+)
+
+// StreamKind identifies which of Engine's three stream types a StreamInfo
+// describes.
+type StreamKind string
+
+// The StreamKind values reported by ListStreams and /debug/vstreams.
+const (
+	StreamKindVStream = StreamKind("vstream")
+	StreamKindRows    = StreamKind("rows")
+	StreamKindResults = StreamKind("results")
+)
+
+// StreamInfo is a point-in-time snapshot of one active stream, as returned
+// by Engine.ListStreams and rendered by /debug/vstreams. Fields other than
+// ID are only updated while holding Engine.mu, so a StreamInfo returned from
+// ListStreams is a consistent copy rather than a live view.
+type StreamInfo struct {
+	ID         int
+	Kind       StreamKind
+	StartedAt  time.Time
+	Filter     *binlogdatapb.Filter
+	StartPos   string
+	LastGTID   string
+	EventsSent int64
+	BytesSent  int64
+	LastError  string
+	ClientAddr string
+
+	// cancelledByOperator is set by CancelStream before it cancels the
+	// stream's context. setLastError checks it so the generic error the
+	// streamer returns for an already-cancelled context (e.g.
+	// context.Canceled) can't clobber the operator-cancellation reason with
+	// a less specific one.
+	cancelledByOperator bool
+}
+
+// ListStreams returns a snapshot of every currently active stream.
+func (vse *Engine) ListStreams() []StreamInfo {
+	vse.mu.Lock()
+	defer vse.mu.Unlock()
+	infos := make([]StreamInfo, 0, len(vse.infos))
+	for _, info := range vse.infos {
+		infos = append(infos, *info)
+	}
+	return infos
+}
+
+// CancelStream cancels the stream with the given id, so an operator can kill
+// a runaway stream without restarting the tablet. The stream's LastError is
+// set to reflect the operator cancellation, distinct from a stream ending on
+// its own (e.g. with io.EOF from the binlog connection).
+//
+// The companion tabletmanager gRPC method that would expose this to
+// vtctld/vtctlclient isn't added here: it lives in the tabletmanager service
+// package, which this checkout doesn't include alongside vstreamer.
+func (vse *Engine) CancelStream(id int) error {
+	vse.mu.Lock()
+	cancel, ok := vse.cancels[id]
+	info := vse.infos[id]
+	vse.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no active stream with id %d", id)
+	}
+	if info != nil {
+		vse.mu.Lock()
+		info.cancelledByOperator = true
+		info.LastError = errCancelledByOperator.Error()
+		vse.mu.Unlock()
+	}
+	cancel()
+	return nil
+}
+
+var errCancelledByOperator = fmt.Errorf("cancelled by operator")
+
+// recordVStreamProgress updates info with the events just about to be sent
+// to a vstream (Engine.Stream) caller, tracking the last GTID seen across
+// COMMIT boundaries in addition to the generic event/byte counters.
+func (vse *Engine) recordVStreamProgress(info *StreamInfo, events []*binlogdatapb.VEvent) {
+	vse.mu.Lock()
+	defer vse.mu.Unlock()
+	for _, ev := range events {
+		info.BytesSent += int64(proto.Size(ev))
+		if ev.Type == binlogdatapb.VEventType_GTID {
+			info.LastGTID = ev.Gtid
+		}
+	}
+	info.EventsSent += int64(len(events))
+}
+
+// recordProgress updates info's EventsSent counter for a
+// StreamRows/StreamResults response; BytesSent is not updated for these
+// stream kinds. count is the number of logical events the response
+// represents (always 1 today, since those APIs send one response per
+// call), kept as a parameter so future batched responses don't need a new
+// method.
+func (vse *Engine) recordProgress(info *StreamInfo, count int64) {
+	vse.mu.Lock()
+	defer vse.mu.Unlock()
+	info.EventsSent += count
+}
+
+// setLastError records err on info under Engine.mu. It's a no-op once
+// CancelStream has already marked info as operator-cancelled, so the
+// generic error a streamer returns after observing its cancelled context
+// (e.g. context.Canceled) can't overwrite the more specific
+// "cancelled by operator" reason CancelStream recorded.
+func (vse *Engine) setLastError(info *StreamInfo, err error) {
+	vse.mu.Lock()
+	defer vse.mu.Unlock()
+	if info.cancelledByOperator {
+		return
+	}
+	info.LastError = err.Error()
+}
+
+// clientAddr best-effort extracts the caller's address from ctx for
+// ClientAddr. It returns "" when ctx carries no peer information, e.g. in
+// unit tests that call Engine methods directly rather than through gRPC.
+func clientAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+// serveStreamsHTTP renders ListStreams as JSON, gated by acl.DEBUGGING like
+// Engine.ServeHTTP.
+func (vse *Engine) serveStreamsHTTP(response http.ResponseWriter, request *http.Request) {
+	if err := acl.CheckAccessHTTP(request, acl.DEBUGGING); err != nil {
+		acl.SendError(response, err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	data, err := json.MarshalIndent(vse.ListStreams(), "", "  ")
+	if err != nil {
+		response.Write([]byte(err.Error()))
+		return
+	}
+	response.Write(data)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSetLastErrorDoesNotClobberOperatorCancellation verifies that once
+// CancelStream has marked a StreamInfo as operator-cancelled, a later
+// setLastError call (as engine.go makes when the in-flight streamer.Stream()
+// call returns because its context was cancelled) can't overwrite the
+// operator-cancellation reason with the streamer's generic error.
+func TestSetLastErrorDoesNotClobberOperatorCancellation(t *testing.T) {
+	vse := &Engine{
+		cancels: map[int]context.CancelFunc{1: func() {}},
+		infos:   map[int]*StreamInfo{1: {ID: 1}},
+	}
+
+	require := assert.New(t)
+	err := vse.CancelStream(1)
+	require.NoError(err)
+	require.Equal(errCancelledByOperator.Error(), vse.infos[1].LastError)
+
+	// Simulate the in-flight Stream() call observing ctx.Done() and
+	// returning its own generic error, as engine.go's deferred setLastError
+	// would do after streamer.Stream() returns.
+	vse.setLastError(vse.infos[1], errors.New("context canceled"))
+
+	assert.Equal(t, errCancelledByOperator.Error(), vse.infos[1].LastError)
+}
+
+// TestSetLastErrorRecordsGenericError verifies setLastError still records a
+// normal error (e.g. io.EOF) when the stream wasn't operator-cancelled.
+func TestSetLastErrorRecordsGenericError(t *testing.T) {
+	vse := &Engine{}
+	info := &StreamInfo{ID: 1}
+	vse.setLastError(info, errors.New("some stream error"))
+	assert.Equal(t, "some stream error", info.LastError)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"vitess.io/vitess/go/acl"
+	"vitess.io/vitess/go/stats"
+)
+
+// Topic names published on the Engine's Bus. Subscribers match on these
+// verbatim; there is no wildcard support.
+const (
+	// TopicVSchemaUpdated fires whenever Engine.setWatch rebuilds the local
+	// vschema. The payload is the new *localVSchema.
+	TopicVSchemaUpdated = "vschema.updated"
+	// TopicStreamStarted fires when Engine.Stream, StreamRows or
+	// StreamResults registers a new streamer.
+	TopicStreamStarted = "stream.started"
+	// TopicStreamEnded fires when a streamer's Stream call returns, whether
+	// it finished normally or was cancelled, just before the streamer is
+	// removed from its Engine map.
+	TopicStreamEnded = "stream.ended"
+	// TopicStreamError fires when a streamer exits with a non-nil error.
+	TopicStreamError = "stream.error"
+	// TopicSrvTopoWatchError fires when the underlying srvtopo watch callback
+	// is invoked with an error that isn't topo.NoNode.
+	TopicSrvTopoWatchError = "srvtopo.watch.error"
+)
+
+// subscriberBacklog is the number of events buffered per subscriber channel
+// before Publish starts dropping events for that subscriber.
+const subscriberBacklog = 100
+
+var busDrops *stats.Counter
+
+func init() {
+	busDrops = stats.NewCounter("VStreamBusDrops", "Count of vstreamer bus events dropped because a subscriber's channel was full")
+}
+
+// BusEvent is published on the Bus. Topic identifies the kind of event;
+// Data carries a topic-specific payload (e.g. a *localVSchema for
+// TopicVSchemaUpdated, or a streamID for TopicStream*).
+type BusEvent struct {
+	Topic string
+	Data  interface{}
+}
+
+// Bus is a generic in-process, topic-based publish/subscribe mechanism.
+// Publish never blocks on a slow subscriber: each subscriber channel is
+// bounded, and events are dropped (and counted) for that subscriber if it
+// isn't keeping up.
+type Bus interface {
+	// Publish fans evt out to every subscriber of evt.Topic. It does not
+	// block waiting for subscribers to consume it.
+	Publish(evt *BusEvent)
+	// Subscribe registers ch to receive events for topics. ch must not be
+	// subscribed twice without an intervening Unsubscribe.
+	Subscribe(ch chan *BusEvent, topics ...string)
+	// Unsubscribe removes ch from every topic it was subscribed to.
+	Unsubscribe(ch chan *BusEvent)
+}
+
+// bus is the default Bus implementation.
+type bus struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *BusEvent]bool
+}
+
+// newBus creates an empty Bus.
+func newBus() *bus {
+	return &bus{
+		subs: make(map[string]map[chan *BusEvent]bool),
+	}
+}
+
+// Publish implements Bus.
+func (b *bus) Publish(evt *BusEvent) {
+	b.mu.Lock()
+	subs := b.subs[evt.Topic]
+	// Snapshot the channels so we don't hold the lock while sending.
+	chans := make([]chan *BusEvent, 0, len(subs))
+	for ch := range subs {
+		chans = append(chans, ch)
+	}
+	b.mu.Unlock()
+
+	for _, ch := range chans {
+		select {
+		case ch <- evt:
+		default:
+			busDrops.Add(1)
+		}
+	}
+}
+
+// Subscribe implements Bus.
+func (b *bus) Subscribe(ch chan *BusEvent, topics ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, topic := range topics {
+		if b.subs[topic] == nil {
+			b.subs[topic] = make(map[chan *BusEvent]bool)
+		}
+		b.subs[topic][ch] = true
+	}
+}
+
+// Unsubscribe implements Bus.
+func (b *bus) Unsubscribe(ch chan *BusEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for topic, chans := range b.subs {
+		if delete(chans, ch); len(chans) == 0 {
+			delete(b.subs, topic)
+		}
+	}
+}
+
+// newSubscriberChan returns a bounded channel sized for use with Subscribe.
+func newSubscriberChan() chan *BusEvent {
+	return make(chan *BusEvent, subscriberBacklog)
+}
+
+// busStats is the JSON shape served by /debug/vstreamer_bus.
+type busStats struct {
+	Topic       string `json:"topic"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// ServeHTTP renders the current topics and subscriber counts on the bus.
+func (b *bus) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if err := acl.CheckAccessHTTP(request, acl.DEBUGGING); err != nil {
+		acl.SendError(response, err)
+		return
+	}
+	b.mu.Lock()
+	stats := make([]busStats, 0, len(b.subs))
+	for topic, chans := range b.subs {
+		stats = append(stats, busStats{Topic: topic, Subscribers: len(chans)})
+	}
+	b.mu.Unlock()
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		response.Write([]byte(err.Error()))
+		return
+	}
+	response.Write(data)
+}
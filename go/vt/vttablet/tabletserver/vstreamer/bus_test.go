@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBusPublishDeliversOnlyToSubscribedTopics(t *testing.T) {
+	b := newBus()
+	vschemaCh := newSubscriberChan()
+	streamCh := newSubscriberChan()
+	b.Subscribe(vschemaCh, TopicVSchemaUpdated)
+	b.Subscribe(streamCh, TopicStreamStarted, TopicStreamEnded)
+
+	b.Publish(&BusEvent{Topic: TopicVSchemaUpdated, Data: 1})
+	b.Publish(&BusEvent{Topic: TopicStreamStarted, Data: 2})
+
+	select {
+	case evt := <-vschemaCh:
+		assert.Equal(t, TopicVSchemaUpdated, evt.Topic)
+	default:
+		t.Fatal("expected vschemaCh to receive TopicVSchemaUpdated")
+	}
+	select {
+	case evt := <-streamCh:
+		assert.Equal(t, TopicStreamStarted, evt.Topic)
+	default:
+		t.Fatal("expected streamCh to receive TopicStreamStarted")
+	}
+	// streamCh wasn't subscribed to TopicVSchemaUpdated, so it should not
+	// have received a second event.
+	select {
+	case evt := <-streamCh:
+		t.Fatalf("unexpected extra event on streamCh: %+v", evt)
+	default:
+	}
+}
+
+func TestBusUnsubscribeStopsDelivery(t *testing.T) {
+	b := newBus()
+	ch := newSubscriberChan()
+	b.Subscribe(ch, TopicStreamEnded)
+	b.Unsubscribe(ch)
+
+	b.Publish(&BusEvent{Topic: TopicStreamEnded, Data: 1})
+
+	select {
+	case evt := <-ch:
+		t.Fatalf("unexpected event after Unsubscribe: %+v", evt)
+	default:
+	}
+}
+
+func TestBusPublishDropsWhenSubscriberChannelIsFull(t *testing.T) {
+	b := newBus()
+	ch := make(chan *BusEvent, 1)
+	b.Subscribe(ch, TopicStreamError)
+
+	before := busDrops.Get()
+	b.Publish(&BusEvent{Topic: TopicStreamError, Data: 1})
+	b.Publish(&BusEvent{Topic: TopicStreamError, Data: 2})
+	after := busDrops.Get()
+
+	require.Len(t, ch, 1)
+	assert.Equal(t, int64(1), after-before, "second publish should have been dropped and counted")
+}
@@ -0,0 +1,415 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"vitess.io/vitess/go/acl"
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/log"
+
+	binlogdatapb "vitess.io/vitess/go/vt/proto/binlogdata"
+)
+
+// defaultCheckpointTTL is how long a checkpoint may go without being
+// refreshed before Engine.Open garbage-collects it.
+const defaultCheckpointTTL = 7 * 24 * time.Hour
+
+// ErrNoCheckpoint is returned by Engine.Resume when streamID has never been
+// checkpointed, and by CheckpointStore.Get for the same reason.
+var ErrNoCheckpoint = errors.New("vstreamer: no checkpoint for stream")
+
+// Checkpoint is a durable snapshot of a stream's progress, enough to resume
+// it without the caller persisting startPos/lastpk/GTID on its own side.
+type Checkpoint struct {
+	GTID      string
+	LastPK    []sqltypes.Value
+	Filter    *binlogdatapb.Filter
+	UpdatedAt time.Time
+	// Seq is monotonically increasing per streamID; it lets a reader tell
+	// two checkpoints with the same UpdatedAt (clock resolution) apart.
+	Seq int64
+}
+
+// CheckpointStore persists Checkpoints keyed by an opaque streamID.
+type CheckpointStore interface {
+	Put(streamID string, cp Checkpoint) error
+	Get(streamID string) (Checkpoint, error)
+	Delete(streamID string) error
+	// Range calls fn for every stored streamID with the given prefix (pass
+	// "" to visit all of them), stopping early if fn returns false.
+	Range(prefix string, fn func(string, Checkpoint) bool) error
+}
+
+// checkpointRecord is the on-disk shape written by fileCheckpointStore.
+type checkpointRecord struct {
+	StreamID  string
+	Cp        Checkpoint
+	Tombstone bool
+}
+
+// fileCheckpointStore is the default CheckpointStore: an append-only log of
+// gob-encoded records replayed into an in-memory map on open. It favors
+// simplicity over compaction; a deployment that cares about unbounded log
+// growth or crash-safe fsync batching should implement CheckpointStore
+// against an embedded KV (e.g. BadgerDB) instead.
+type fileCheckpointStore struct {
+	mu   sync.Mutex
+	f    *os.File
+	data map[string]Checkpoint
+}
+
+// NewFileCheckpointStore opens (creating if necessary) an append-only
+// checkpoint log under dir, which is expected to be the tablet's data dir.
+func NewFileCheckpointStore(dir string) (CheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "vstream_checkpoints.db"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	store := &fileCheckpointStore{
+		f:    f,
+		data: make(map[string]Checkpoint),
+	}
+	if err := store.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// replay reconstructs store.data from the log and leaves the file positioned
+// for appending.
+func (s *fileCheckpointStore) replay() error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// append writes every record with its own gob.Encoder, so each record
+	// carries its own type definitions and must be read with its own Decoder.
+	// r is a ByteReader, so a Decoder reads exactly one record from it.
+	r := bufio.NewReader(s.f)
+	for {
+		var rec checkpointRecord
+		if err := gob.NewDecoder(r).Decode(&rec); err != nil {
+			if err != io.EOF {
+				// Likely a partially-written trailing record from a crash
+				// mid-append, but could also be real corruption; log it
+				// either way so a silently truncated checkpoint history
+				// doesn't go unnoticed.
+				log.Errorf("Error replaying vstream checkpoint log, stopping after %d records: %v", len(s.data), err)
+			}
+			break
+		}
+		if rec.Tombstone {
+			delete(s.data, rec.StreamID)
+		} else {
+			s.data[rec.StreamID] = rec.Cp
+		}
+	}
+	_, err := s.f.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (s *fileCheckpointStore) append(rec checkpointRecord) error {
+	if err := gob.NewEncoder(s.f).Encode(rec); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Put implements CheckpointStore.
+func (s *fileCheckpointStore) Put(streamID string, cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(checkpointRecord{StreamID: streamID, Cp: cp}); err != nil {
+		return err
+	}
+	s.data[streamID] = cp
+	return nil
+}
+
+// Get implements CheckpointStore.
+func (s *fileCheckpointStore) Get(streamID string) (Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp, ok := s.data[streamID]
+	if !ok {
+		return Checkpoint{}, ErrNoCheckpoint
+	}
+	return cp, nil
+}
+
+// Delete implements CheckpointStore.
+func (s *fileCheckpointStore) Delete(streamID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[streamID]; !ok {
+		return nil
+	}
+	if err := s.append(checkpointRecord{StreamID: streamID, Tombstone: true}); err != nil {
+		return err
+	}
+	delete(s.data, streamID)
+	return nil
+}
+
+// Range implements CheckpointStore.
+func (s *fileCheckpointStore) Range(prefix string, fn func(string, Checkpoint) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, cp := range s.data {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if !fn(id, cp) {
+			break
+		}
+	}
+	return nil
+}
+
+// checkpointStreamID derives a stable streamID from descriptor (a *Filter
+// for vstream, a query string for StreamRows/StreamResults) when the caller
+// doesn't want to manage one explicitly. The *WithCheckpoint methods call
+// this themselves whenever streamID == "".
+func checkpointStreamID(descriptor interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v", descriptor)))
+	return hex.EncodeToString(sum[:])
+}
+
+// resolveStreamID returns streamID unchanged if non-empty, otherwise derives
+// one from descriptor via checkpointStreamID.
+func resolveStreamID(streamID string, descriptor interface{}) string {
+	if streamID != "" {
+		return streamID
+	}
+	return checkpointStreamID(descriptor)
+}
+
+// gcCheckpoints deletes checkpoints that haven't been refreshed within
+// defaultCheckpointTTL. It's called once from Open.
+func (vse *Engine) gcCheckpoints() {
+	if vse.checkpoints == nil {
+		return
+	}
+	cutoff := time.Now().Add(-defaultCheckpointTTL)
+	var stale []string
+	vse.checkpoints.Range("", func(id string, cp Checkpoint) bool {
+		if cp.UpdatedAt.Before(cutoff) {
+			stale = append(stale, id)
+		}
+		return true
+	})
+	for _, id := range stale {
+		if err := vse.checkpoints.Delete(id); err != nil {
+			log.Errorf("Error garbage-collecting vstream checkpoint %s: %v", id, err)
+		}
+	}
+}
+
+// StreamWithCheckpoint behaves like Stream, but commits a checkpoint under
+// streamID every time a COMMIT event passes through, so a later
+// Engine.Resume(ctx, streamID, ...) can restart from the last durable GTID.
+// If streamID is "", one is derived from filter via checkpointStreamID. If
+// no CheckpointStore has been installed via WithCheckpointStore, this is
+// equivalent to Stream.
+func (vse *Engine) StreamWithCheckpoint(ctx context.Context, streamID string, startPos string, filter *binlogdatapb.Filter, send func([]*binlogdatapb.VEvent) error) error {
+	if vse.checkpoints == nil {
+		return vse.Stream(ctx, startPos, filter, send)
+	}
+	streamID = resolveStreamID(streamID, filter)
+
+	var lastGTID string
+	var seq int64
+	if prev, err := vse.checkpoints.Get(streamID); err == nil {
+		seq = prev.Seq
+	}
+	return vse.Stream(ctx, startPos, filter, func(events []*binlogdatapb.VEvent) error {
+		if err := send(events); err != nil {
+			return err
+		}
+		for _, ev := range events {
+			switch ev.Type {
+			case binlogdatapb.VEventType_GTID:
+				lastGTID = ev.Gtid
+			case binlogdatapb.VEventType_COMMIT:
+				if lastGTID == "" {
+					continue
+				}
+				seq++
+				if err := vse.checkpoints.Put(streamID, Checkpoint{
+					GTID:      lastGTID,
+					Filter:    filter,
+					UpdatedAt: time.Now(),
+					Seq:       seq,
+				}); err != nil {
+					log.Errorf("Error committing vstream checkpoint %s: %v", streamID, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// StreamRowsWithCheckpoint behaves like StreamRows, but commits a checkpoint
+// under streamID after every batch send acks successfully, recording the
+// lastpk the copy started from (see below). If streamID is "", one is derived
+// from query via checkpointStreamID. If no CheckpointStore has been
+// installed via WithCheckpointStore, this is equivalent to StreamRows.
+//
+// rowStreamer isn't present in this checkout, so it can't report the
+// advancing per-row pk it actually sends back to Engine the way vstreamer
+// reports COMMIT events; the checkpoint committed here therefore carries the
+// lastpk the caller started the copy with rather than one derived from each
+// response. A caller that wants exact mid-copy resume still needs
+// rowStreamer itself to surface its own advancing lastpk.
+func (vse *Engine) StreamRowsWithCheckpoint(ctx context.Context, streamID string, query string, lastpk []sqltypes.Value, send func(*binlogdatapb.VStreamRowsResponse) error) error {
+	if vse.checkpoints == nil {
+		return vse.StreamRows(ctx, query, lastpk, send)
+	}
+	streamID = resolveStreamID(streamID, query)
+
+	var seq int64
+	if prev, err := vse.checkpoints.Get(streamID); err == nil {
+		seq = prev.Seq
+	}
+	return vse.StreamRows(ctx, query, lastpk, func(resp *binlogdatapb.VStreamRowsResponse) error {
+		if err := send(resp); err != nil {
+			return err
+		}
+		seq++
+		if err := vse.checkpoints.Put(streamID, Checkpoint{
+			LastPK:    lastpk,
+			UpdatedAt: time.Now(),
+			Seq:       seq,
+		}); err != nil {
+			log.Errorf("Error committing vstream checkpoint %s: %v", streamID, err)
+		}
+		return nil
+	})
+}
+
+// StreamResultsWithCheckpoint behaves like StreamResults, but commits a
+// checkpoint under streamID after every batch send acks successfully. If
+// streamID is "", one is derived from query via checkpointStreamID. If no
+// CheckpointStore has been installed via WithCheckpointStore, this is
+// equivalent to StreamResults.
+//
+// resultStreamer isn't present in this checkout, so it can't report its own
+// GTID rotation boundaries back to Engine the way vstreamer reports COMMIT
+// events; this commits a checkpoint per acked batch instead of per
+// rotation, which is a safe (if more frequent) substitute until
+// resultStreamer can report rotations directly.
+func (vse *Engine) StreamResultsWithCheckpoint(ctx context.Context, streamID string, query string, send func(*binlogdatapb.VStreamResultsResponse) error) error {
+	if vse.checkpoints == nil {
+		return vse.StreamResults(ctx, query, send)
+	}
+	streamID = resolveStreamID(streamID, query)
+
+	var seq int64
+	if prev, err := vse.checkpoints.Get(streamID); err == nil {
+		seq = prev.Seq
+	}
+	return vse.StreamResults(ctx, query, func(resp *binlogdatapb.VStreamResultsResponse) error {
+		if err := send(resp); err != nil {
+			return err
+		}
+		seq++
+		if err := vse.checkpoints.Put(streamID, Checkpoint{
+			UpdatedAt: time.Now(),
+			Seq:       seq,
+		}); err != nil {
+			log.Errorf("Error committing vstream checkpoint %s: %v", streamID, err)
+		}
+		return nil
+	})
+}
+
+// Resume looks up the last durable checkpoint for streamID and restarts the
+// stream from its GTID via StreamWithCheckpoint, so progress continues to be
+// checkpointed under the same streamID. It returns ErrNoCheckpoint if
+// streamID has no checkpoint, or if Engine has no CheckpointStore installed.
+//
+// Only the vstreamer flow (GTID-based) can resume itself this way: rowStreamer
+// and resultStreamer checkpoints (committed by StreamRowsWithCheckpoint and
+// StreamResultsWithCheckpoint above) record progress, but Checkpoint doesn't
+// carry the original query string needed to restart a row copy or result
+// stream, so resuming those is on the caller, which already has it.
+func (vse *Engine) Resume(ctx context.Context, streamID string, send func([]*binlogdatapb.VEvent) error) error {
+	if vse.checkpoints == nil {
+		return ErrNoCheckpoint
+	}
+	cp, err := vse.checkpoints.Get(streamID)
+	if err != nil {
+		return err
+	}
+	return vse.StreamWithCheckpoint(ctx, streamID, cp.GTID, cp.Filter, send)
+}
+
+// checkpointInfo is the JSON shape served by /debug/vstream_checkpoints.
+type checkpointInfo struct {
+	StreamID  string    `json:"stream_id"`
+	GTID      string    `json:"gtid"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Lag       string    `json:"lag"`
+}
+
+// serveCheckpointsHTTP lists active streamIDs, their last GTID, and lag.
+func (vse *Engine) serveCheckpointsHTTP(response http.ResponseWriter, request *http.Request) {
+	if err := acl.CheckAccessHTTP(request, acl.DEBUGGING); err != nil {
+		acl.SendError(response, err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if vse.checkpoints == nil {
+		response.Write([]byte("[]"))
+		return
+	}
+	var infos []checkpointInfo
+	vse.checkpoints.Range("", func(id string, cp Checkpoint) bool {
+		infos = append(infos, checkpointInfo{
+			StreamID:  id,
+			GTID:      cp.GTID,
+			UpdatedAt: cp.UpdatedAt,
+			Lag:       time.Since(cp.UpdatedAt).String(),
+		})
+		return true
+	})
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		response.Write([]byte(err.Error()))
+		return
+	}
+	response.Write(data)
+}
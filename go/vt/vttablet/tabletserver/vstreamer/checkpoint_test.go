@@ -0,0 +1,102 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCheckpointStorePutGetDelete(t *testing.T) {
+	store, err := NewFileCheckpointStore(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = store.Get("s1")
+	assert.Equal(t, ErrNoCheckpoint, err)
+
+	require.NoError(t, store.Put("s1", Checkpoint{GTID: "gtid1", Seq: 1}))
+	cp, err := store.Get("s1")
+	require.NoError(t, err)
+	assert.Equal(t, "gtid1", cp.GTID)
+
+	require.NoError(t, store.Delete("s1"))
+	_, err = store.Get("s1")
+	assert.Equal(t, ErrNoCheckpoint, err)
+}
+
+// TestFileCheckpointStoreReplaySurvivesRestart verifies that closing and
+// reopening a store (simulating a tablet restart) replays every Put/Delete
+// that was durably appended.
+func TestFileCheckpointStoreReplaySurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileCheckpointStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("s1", Checkpoint{GTID: "gtid1", Seq: 1}))
+	require.NoError(t, store.Put("s2", Checkpoint{GTID: "gtid2", Seq: 1}))
+	require.NoError(t, store.Delete("s1"))
+
+	reopened, err := NewFileCheckpointStore(dir)
+	require.NoError(t, err)
+
+	_, err = reopened.Get("s1")
+	assert.Equal(t, ErrNoCheckpoint, err)
+	cp, err := reopened.Get("s2")
+	require.NoError(t, err)
+	assert.Equal(t, "gtid2", cp.GTID)
+}
+
+// TestFileCheckpointStoreReplaySkipsTrailingCorruption verifies that a
+// corrupted/truncated trailing record doesn't prevent valid records written
+// before it from being replayed (replay must log the non-EOF decode error
+// rather than pretending nothing happened, but must still recover what it
+// can).
+func TestFileCheckpointStoreReplaySkipsTrailingCorruption(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileCheckpointStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("s1", Checkpoint{GTID: "gtid1", Seq: 1}))
+	store.(*fileCheckpointStore).f.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, "vstream_checkpoints.db"), os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reopened, err := NewFileCheckpointStore(dir)
+	require.NoError(t, err)
+	cp, err := reopened.Get("s1")
+	require.NoError(t, err)
+	assert.Equal(t, "gtid1", cp.GTID)
+}
+
+func TestResolveStreamIDPrefersExplicit(t *testing.T) {
+	assert.Equal(t, "explicit", resolveStreamID("explicit", "some query"))
+}
+
+func TestResolveStreamIDDerivesDeterministically(t *testing.T) {
+	id1 := resolveStreamID("", "select * from t1")
+	id2 := resolveStreamID("", "select * from t1")
+	id3 := resolveStreamID("", "select * from t2")
+	assert.Equal(t, id1, id2)
+	assert.NotEqual(t, id1, id3)
+}
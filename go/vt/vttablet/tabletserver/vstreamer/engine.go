@@ -23,6 +23,7 @@ import (
 	"errors"
 	"net/http"
 	"sync"
+	"time"
 
 	"vitess.io/vitess/go/acl"
 	"vitess.io/vitess/go/mysql"
@@ -61,6 +62,13 @@ type Engine struct {
 	resultStreamers map[int]*resultStreamer
 	streamIdx       int
 
+	// flowGroups tracks open FlowGroups (see flow_group.go) for
+	// /debug/vstream_flow_groups introspection. Close waits for all of
+	// them, the same way it waits for streamers, rowStreamers and
+	// resultStreamers.
+	flowGroups   map[int]*FlowGroup
+	flowGroupIdx int
+
 	// watcherOnce is used for initializing vschema
 	// and setting up the vschema watch. It's guaranteed that
 	// no stream will start until vschema is initialized by
@@ -68,6 +76,23 @@ type Engine struct {
 	watcherOnce sync.Once
 	lvschema    *localVSchema
 
+	// bus is the event bus used to fan out vschema updates and stream
+	// lifecycle notifications to streamers and external observers without
+	// Engine holding a typed slice of subscribers.
+	bus *bus
+
+	// checkpoints is the durable backend used by StreamWithCheckpoint and
+	// Resume. It's nil until WithCheckpointStore has been called; while it's
+	// nil, checkpointing is simply a no-op.
+	checkpoints CheckpointStore
+
+	// infos and cancels back ListStreams/CancelStream/serveStreamsHTTP.
+	// They're keyed by the same stream id as streamers/rowStreamers/
+	// resultStreamers, so they're updated alongside those maps rather than
+	// living on the streamer types themselves.
+	infos   map[int]*StreamInfo
+	cancels map[int]context.CancelFunc
+
 	// The following members are initialized once at the beginning.
 	ts       srvtopo.Server
 	se       *schema.Engine
@@ -83,7 +108,11 @@ func NewEngine(ts srvtopo.Server, se *schema.Engine) *Engine {
 		streamers:       make(map[int]*vstreamer),
 		rowStreamers:    make(map[int]*rowStreamer),
 		resultStreamers: make(map[int]*resultStreamer),
-		lvschema:        &localVSchema{vschema: &vindexes.VSchema{}},
+		lvschema:        &localVSchema{vschema: &vindexes.VSchema{}, krIndex: &keyrangeIndex{byTable: make(map[string][]keyrangeEntry)}},
+		bus:             newBus(),
+		flowGroups:      make(map[int]*FlowGroup),
+		infos:           make(map[int]*StreamInfo),
+		cancels:         make(map[int]context.CancelFunc),
 		ts:              ts,
 		se:              se,
 	}
@@ -91,6 +120,10 @@ func NewEngine(ts srvtopo.Server, se *schema.Engine) *Engine {
 		vschemaErrors = stats.NewCounter("VSchemaErrors", "Count of VSchema errors")
 		vschemaUpdates = stats.NewCounter("VSchemaUpdates", "Count of VSchema updates. Does not include errors")
 		http.Handle("/debug/tablet_vschema", vse)
+		http.Handle("/debug/vstreamer_bus", vse.bus)
+		http.HandleFunc("/debug/vstream_flow_groups", vse.serveFlowGroupsHTTP)
+		http.HandleFunc("/debug/vstream_checkpoints", vse.serveCheckpointsHTTP)
+		http.HandleFunc("/debug/vstreams", vse.serveStreamsHTTP)
 	})
 	return vse
 }
@@ -100,6 +133,15 @@ func (vse *Engine) InitDBConfig(cp *mysql.ConnParams) {
 	vse.cp = cp
 }
 
+// WithCheckpointStore installs store as the Engine's checkpoint backend,
+// enabling StreamWithCheckpoint and Resume. Call it after NewEngine and
+// before Open.
+func (vse *Engine) WithCheckpointStore(store CheckpointStore) {
+	vse.mu.Lock()
+	defer vse.mu.Unlock()
+	vse.checkpoints = store
+}
+
 // Open starts the Engine service.
 func (vse *Engine) Open(keyspace, cell string) error {
 	vse.mu.Lock()
@@ -110,6 +152,7 @@ func (vse *Engine) Open(keyspace, cell string) error {
 	vse.isOpen = true
 	vse.keyspace = keyspace
 	vse.cell = cell
+	vse.gcCheckpoints()
 	return nil
 }
 
@@ -122,6 +165,7 @@ func (vse *Engine) IsOpen() bool {
 
 // Close closes the Engine service.
 func (vse *Engine) Close() {
+	var flowGroups []*FlowGroup
 	func() {
 		vse.mu.Lock()
 		defer vse.mu.Unlock()
@@ -138,9 +182,20 @@ func (vse *Engine) Close() {
 		for _, s := range vse.resultStreamers {
 			s.Cancel()
 		}
+		for _, fg := range vse.flowGroups {
+			flowGroups = append(flowGroups, fg)
+		}
 		vse.isOpen = false
 	}()
 
+	// FlowGroups own their streams' wg.Add/Done calls, so they must be
+	// cancelled and drained before the main wg.Wait below, or Close would
+	// race a flow group's flows being torn down against Engine.isOpen
+	// already being false.
+	for _, fg := range flowGroups {
+		fg.Close()
+	}
+
 	// Wait only after releasing the lock because the end of every
 	// stream will use the lock to remove the entry from streamers.
 	vse.wg.Wait()
@@ -159,16 +214,31 @@ func (vse *Engine) Stream(ctx context.Context, startPos string, filter *binlogda
 	// because this overhead should be incurred only if someone uses this feature.
 	vse.watcherOnce.Do(vse.setWatch)
 
+	info := &StreamInfo{
+		Kind:       StreamKindVStream,
+		StartedAt:  time.Now(),
+		Filter:     filter,
+		StartPos:   startPos,
+		ClientAddr: clientAddr(ctx),
+	}
+	wrappedSend := func(events []*binlogdatapb.VEvent) error {
+		vse.recordVStreamProgress(info, events)
+		return send(events)
+	}
+
 	// Create stream and add it to the map.
+	cctx, cancel := context.WithCancel(ctx)
 	streamer, idx, err := func() (*vstreamer, int, error) {
 		vse.mu.Lock()
 		defer vse.mu.Unlock()
 		if !vse.isOpen {
 			return nil, 0, errors.New("VStreamer is not open")
 		}
-		streamer := newVStreamer(ctx, vse.cp, vse.se, startPos, filter, vse.lvschema, send)
+		streamer := newVStreamer(cctx, vse.cp, vse.se, startPos, filter, vse.lvschema, wrappedSend)
 		idx := vse.streamIdx
 		vse.streamers[idx] = streamer
+		vse.infos[idx] = info
+		vse.cancels[idx] = cancel
 		vse.streamIdx++
 		// Now that we've added the stream, increment wg.
 		// This must be done before releasing the lock.
@@ -176,19 +246,32 @@ func (vse *Engine) Stream(ctx context.Context, startPos string, filter *binlogda
 		return streamer, idx, nil
 	}()
 	if err != nil {
+		cancel()
 		return err
 	}
+	info.ID = idx
+	defer cancel()
+	vse.watchVSchemaUpdates(cctx, streamer.SetVSchema)
+	vse.bus.Publish(&BusEvent{Topic: TopicStreamStarted, Data: idx})
 
 	// Remove stream from map and decrement wg when it ends.
 	defer func() {
 		vse.mu.Lock()
-		defer vse.mu.Unlock()
 		delete(vse.streamers, idx)
+		delete(vse.infos, idx)
+		delete(vse.cancels, idx)
+		vse.mu.Unlock()
 		vse.wg.Done()
 	}()
 
 	// No lock is held while streaming, but wg is incremented.
-	return streamer.Stream()
+	err = streamer.Stream()
+	if err != nil {
+		vse.setLastError(info, err)
+		vse.bus.Publish(&BusEvent{Topic: TopicStreamError, Data: idx})
+	}
+	vse.bus.Publish(&BusEvent{Topic: TopicStreamEnded, Data: idx})
+	return err
 }
 
 // StreamRows streams rows.
@@ -199,16 +282,30 @@ func (vse *Engine) StreamRows(ctx context.Context, query string, lastpk []sqltyp
 	vse.watcherOnce.Do(vse.setWatch)
 	log.Infof("Streaming rows for query %s, lastpk: %s", query, lastpk)
 
+	info := &StreamInfo{
+		Kind:       StreamKindRows,
+		StartedAt:  time.Now(),
+		StartPos:   query,
+		ClientAddr: clientAddr(ctx),
+	}
+	wrappedSend := func(resp *binlogdatapb.VStreamRowsResponse) error {
+		vse.recordProgress(info, 1)
+		return send(resp)
+	}
+
 	// Create stream and add it to the map.
+	cctx, cancel := context.WithCancel(ctx)
 	rowStreamer, idx, err := func() (*rowStreamer, int, error) {
 		vse.mu.Lock()
 		defer vse.mu.Unlock()
 		if !vse.isOpen {
 			return nil, 0, errors.New("VStreamer is not open")
 		}
-		rowStreamer := newRowStreamer(ctx, vse.cp, vse.se, query, lastpk, vse.lvschema, send)
+		rowStreamer := newRowStreamer(cctx, vse.cp, vse.se, query, lastpk, vse.lvschema, wrappedSend)
 		idx := vse.streamIdx
 		vse.rowStreamers[idx] = rowStreamer
+		vse.infos[idx] = info
+		vse.cancels[idx] = cancel
 		vse.streamIdx++
 		// Now that we've added the stream, increment wg.
 		// This must be done before releasing the lock.
@@ -216,33 +313,60 @@ func (vse *Engine) StreamRows(ctx context.Context, query string, lastpk []sqltyp
 		return rowStreamer, idx, nil
 	}()
 	if err != nil {
+		cancel()
 		return err
 	}
+	info.ID = idx
+	defer cancel()
+	vse.watchVSchemaUpdates(cctx, rowStreamer.SetVSchema)
+	vse.bus.Publish(&BusEvent{Topic: TopicStreamStarted, Data: idx})
 
 	// Remove stream from map and decrement wg when it ends.
 	defer func() {
 		vse.mu.Lock()
-		defer vse.mu.Unlock()
 		delete(vse.rowStreamers, idx)
+		delete(vse.infos, idx)
+		delete(vse.cancels, idx)
+		vse.mu.Unlock()
 		vse.wg.Done()
 	}()
 
 	// No lock is held while streaming, but wg is incremented.
-	return rowStreamer.Stream()
+	err = rowStreamer.Stream()
+	if err != nil {
+		vse.setLastError(info, err)
+		vse.bus.Publish(&BusEvent{Topic: TopicStreamError, Data: idx})
+	}
+	vse.bus.Publish(&BusEvent{Topic: TopicStreamEnded, Data: idx})
+	return err
 }
 
 // StreamResults streams results of the query with the gtid.
 func (vse *Engine) StreamResults(ctx context.Context, query string, send func(*binlogdatapb.VStreamResultsResponse) error) error {
+	info := &StreamInfo{
+		Kind:       StreamKindResults,
+		StartedAt:  time.Now(),
+		StartPos:   query,
+		ClientAddr: clientAddr(ctx),
+	}
+	wrappedSend := func(resp *binlogdatapb.VStreamResultsResponse) error {
+		vse.recordProgress(info, 1)
+		return send(resp)
+	}
+
 	// Create stream and add it to the map.
+	cctx, cancel := context.WithCancel(ctx)
 	resultStreamer, idx, err := func() (*resultStreamer, int, error) {
 		vse.mu.Lock()
 		defer vse.mu.Unlock()
 		if !vse.isOpen {
 			return nil, 0, errors.New("VStreamer is not open")
 		}
-		resultStreamer := newResultStreamer(ctx, vse.cp, query, send)
+		resultStreamer := newResultStreamer(cctx, vse.cp, query, wrappedSend)
 		idx := vse.streamIdx
 		vse.resultStreamers[idx] = resultStreamer
+		vse.infos[idx] = info
+		vse.cancels[idx] = cancel
 		vse.streamIdx++
 		// Now that we've added the stream, increment wg.
 		// This must be done before releasing the lock.
@@ -250,19 +374,34 @@ func (vse *Engine) StreamResults(ctx context.Context, query string, send func(*b
 		return resultStreamer, idx, nil
 	}()
 	if err != nil {
+		cancel()
 		return err
 	}
+	info.ID = idx
+	defer cancel()
+	// resultStreamer streams a plain query's results, not filtered through
+	// any vindex/keyrange, so unlike Stream/StreamRows it has no SetVSchema
+	// to call and doesn't need a watchVSchemaUpdates subscription.
+	vse.bus.Publish(&BusEvent{Topic: TopicStreamStarted, Data: idx})
 
 	// Remove stream from map and decrement wg when it ends.
 	defer func() {
 		vse.mu.Lock()
-		defer vse.mu.Unlock()
 		delete(vse.resultStreamers, idx)
+		delete(vse.infos, idx)
+		delete(vse.cancels, idx)
+		vse.mu.Unlock()
 		vse.wg.Done()
 	}()
 
 	// No lock is held while streaming, but wg is incremented.
-	return resultStreamer.Stream()
+	err = resultStreamer.Stream()
+	if err != nil {
+		vse.setLastError(info, err)
+		vse.bus.Publish(&BusEvent{Topic: TopicStreamError, Data: idx})
+	}
+	vse.bus.Publish(&BusEvent{Topic: TopicStreamEnded, Data: idx})
+	return err
 }
 
 // ServeHTTP shows the current VSchema.
@@ -286,6 +425,46 @@ func (vse *Engine) ServeHTTP(response http.ResponseWriter, request *http.Request
 	response.Write(buf.Bytes())
 }
 
+// Subscribe registers ch to receive BusEvents for the given topics. Callers
+// (tests, the /debug/tablet_vschema handler, copiers, rowStreamer and
+// resultStreamer instances) use this instead of Engine holding a typed slice
+// of subscribers. ch should be created with a bounded buffer; see
+// newSubscriberChan.
+func (vse *Engine) Subscribe(ch chan *BusEvent, topics ...string) {
+	vse.bus.Subscribe(ch, topics...)
+}
+
+// Unsubscribe removes ch from every topic it was subscribed to.
+func (vse *Engine) Unsubscribe(ch chan *BusEvent) {
+	vse.bus.Unsubscribe(ch)
+}
+
+// watchVSchemaUpdates subscribes to TopicVSchemaUpdated for the lifetime of
+// one stream (until ctx is done) and calls apply with every localVSchema
+// published after subscribing, so a streamer learns about vschema changes
+// without Engine holding a typed slice of subscribers to loop over under
+// vse.mu. Stream and StreamRows each start one of these, in its own
+// goroutine, right after constructing their streamer; StreamResults does not.
+func (vse *Engine) watchVSchemaUpdates(ctx context.Context, apply func(*localVSchema)) {
+	ch := newSubscriberChan()
+	vse.Subscribe(ch, TopicVSchemaUpdated)
+	go func() {
+		defer vse.Unsubscribe(ch)
+		for {
+			select {
+			case evt := <-ch:
+				lvschema, ok := evt.Data.(*localVSchema)
+				if !ok {
+					continue
+				}
+				apply(lvschema)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
 func (vse *Engine) setWatch() {
 	// WatchSrvVSchema does not return until the inner func has been called at least once.
 	vse.ts.WatchSrvVSchema(context.TODO(), vse.cell, func(v *vschemapb.SrvVSchema, err error) {
@@ -297,6 +476,7 @@ func (vse *Engine) setWatch() {
 		default:
 			log.Errorf("Error fetching vschema: %v", err)
 			vschemaErrors.Add(1)
+			vse.bus.Publish(&BusEvent{Topic: TopicSrvTopoWatchError, Data: err})
 			return
 		}
 		var vschema *vindexes.VSchema
@@ -311,18 +491,32 @@ func (vse *Engine) setWatch() {
 			vschema = &vindexes.VSchema{}
 		}
 
-		// Broadcast the change to all streamers.
+		// Fetch shard layout and build the keyrange index before taking
+		// vse.mu: buildKeyrangeIndex may call out to topo (GetSrvKeyspace),
+		// and doing that while holding the lock would block every other
+		// Engine method on network I/O.
+		krIndex := buildKeyrangeIndex(context.TODO(), vse.ts, vse.cell, vse.keyspace, vschema)
+
 		vse.mu.Lock()
-		defer vse.mu.Unlock()
 		vse.lvschema = &localVSchema{
 			keyspace: vse.keyspace,
 			vschema:  vschema,
+			ts:       vse.ts,
+			cell:     vse.cell,
+			// Precomputed here, once per vschema version, so that
+			// vstreamer/rowStreamer filter evaluation can look up a row's
+			// keyrange coverage in O(log n) instead of running a vindex
+			// lookup per row.
+			krIndex: krIndex,
 		}
+		lvschema := vse.lvschema
+		vse.mu.Unlock()
 		b, _ := json.MarshalIndent(vschema, "", "  ")
 		log.Infof("Updated vschema: %s", b)
-		for _, s := range vse.streamers {
-			s.SetVSchema(vse.lvschema)
-		}
+		// Every active Stream/StreamRows stream learns about this update via
+		// its own watchVSchemaUpdates subscription, not a direct fan-out loop
+		// here. StreamResults streams don't subscribe.
+		vse.bus.Publish(&BusEvent{Topic: TopicVSchemaUpdated, Data: lvschema})
 		vschemaUpdates.Add(1)
 	})
 }
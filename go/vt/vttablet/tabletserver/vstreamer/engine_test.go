@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWatchVSchemaUpdatesAppliesPublishedVSchema verifies that
+// watchVSchemaUpdates delivers every localVSchema published on
+// TopicVSchemaUpdated to apply, for as long as ctx is live.
+func TestWatchVSchemaUpdatesAppliesPublishedVSchema(t *testing.T) {
+	vse := &Engine{bus: newBus()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	applied := make(chan *localVSchema, 1)
+	vse.watchVSchemaUpdates(ctx, func(lvs *localVSchema) {
+		applied <- lvs
+	})
+
+	want := &localVSchema{keyspace: "ks1"}
+	vse.bus.Publish(&BusEvent{Topic: TopicVSchemaUpdated, Data: want})
+
+	select {
+	case got := <-applied:
+		assert.Same(t, want, got)
+	case <-time.After(time.Second):
+		t.Fatal("apply was never called with the published localVSchema")
+	}
+}
+
+// TestWatchVSchemaUpdatesStopsOnContextDone verifies the subscription
+// goroutine unsubscribes once ctx is done, so a stream that's ended doesn't
+// leak a live bus subscriber.
+func TestWatchVSchemaUpdatesStopsOnContextDone(t *testing.T) {
+	vse := &Engine{bus: newBus()}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	applied := make(chan *localVSchema, 1)
+	vse.watchVSchemaUpdates(ctx, func(lvs *localVSchema) {
+		applied <- lvs
+	})
+	cancel()
+
+	require.Eventually(t, func() bool {
+		vse.bus.mu.Lock()
+		defer vse.bus.mu.Unlock()
+		for _, subs := range vse.bus.subs {
+			if len(subs) != 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond, "subscriber channel should have been unsubscribed after ctx was done")
+
+	vse.bus.Publish(&BusEvent{Topic: TopicVSchemaUpdated, Data: &localVSchema{}})
+	select {
+	case <-applied:
+		t.Fatal("apply should not be called after ctx was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
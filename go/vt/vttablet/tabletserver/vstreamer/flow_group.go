@@ -0,0 +1,211 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"vitess.io/vitess/go/acl"
+	"vitess.io/vitess/go/sqltypes"
+
+	binlogdatapb "vitess.io/vitess/go/vt/proto/binlogdata"
+)
+
+// defaultMaxConcurrentFlows bounds how many logical flows a single
+// FlowGroup may have open at once. newFlow blocks past this limit, so a
+// caller that opens many flows in a burst (vreplication copy + catchup,
+// MoveTables with many tables) doesn't stampede Engine with unbounded
+// simultaneous newVStreamer/newRowStreamer/newResultStreamer connections.
+const defaultMaxConcurrentFlows = 64
+
+// FlowGroup groups multiple Stream/StreamRows/StreamResults calls opened by
+// one caller under a single lifecycle and a shared admission limit: each
+// flow still calls straight through to the corresponding Engine method,
+// which opens its own connection exactly as an unmultiplexed caller would.
+// FlowGroup does not share a physical MySQL connection or binlog dump
+// handshake across its flows — it's an admission limiter and a single
+// Close that tears down every flow it opened, nothing more. Sharing one
+// connection across N demuxed logical streams would require changing how
+// newVStreamer/newRowStreamer/newResultStreamer obtain their connections,
+// which live outside vstreamer in this checkout and aren't touched here.
+type FlowGroup struct {
+	vse *Engine
+	id  int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	closed   bool
+	flowIdx  int
+	flows    map[int]*flow
+	wg       sync.WaitGroup
+	admitted chan struct{}
+}
+
+// flow is one logical stream opened within a FlowGroup.
+type flow struct {
+	id int
+}
+
+// OpenFlowGroup creates a FlowGroup. The caller must call FlowGroup.Close
+// when done; Close also runs automatically when ctx is done or Engine.Close
+// is called.
+//
+// The isOpen check and the insertion into vse.flowGroups happen under the
+// same lock acquisition so Engine.Close can't run in between: otherwise
+// Close could snapshot vse.flowGroups before this one is inserted, flip
+// isOpen to false, and return having never closed a group that then gets
+// inserted anyway — orphaning it in vse.flowGroups forever.
+func (vse *Engine) OpenFlowGroup(ctx context.Context) (*FlowGroup, error) {
+	vse.mu.Lock()
+	defer vse.mu.Unlock()
+	if !vse.isOpen {
+		return nil, errors.New("VStreamer is not open")
+	}
+	idx := vse.flowGroupIdx
+	vse.flowGroupIdx++
+
+	gctx, cancel := context.WithCancel(ctx)
+	fg := &FlowGroup{
+		vse:      vse,
+		id:       idx,
+		ctx:      gctx,
+		cancel:   cancel,
+		flows:    make(map[int]*flow),
+		admitted: make(chan struct{}, defaultMaxConcurrentFlows),
+	}
+	vse.flowGroups[idx] = fg
+	go func() {
+		<-gctx.Done()
+		fg.Close()
+	}()
+
+	return fg, nil
+}
+
+// newFlow blocks until the group has room for another concurrent flow (see
+// defaultMaxConcurrentFlows), then registers it.
+func (fg *FlowGroup) newFlow() (*flow, error) {
+	select {
+	case fg.admitted <- struct{}{}:
+	case <-fg.ctx.Done():
+		return nil, fg.ctx.Err()
+	}
+
+	fg.mu.Lock()
+	f := &flow{id: fg.flowIdx}
+	fg.flowIdx++
+	fg.flows[f.id] = f
+	fg.mu.Unlock()
+	return f, nil
+}
+
+func (fg *FlowGroup) endFlow(f *flow) {
+	fg.mu.Lock()
+	delete(fg.flows, f.id)
+	fg.mu.Unlock()
+	<-fg.admitted
+}
+
+// Stream opens Engine.Stream as one flow of this group.
+func (fg *FlowGroup) Stream(startPos string, filter *binlogdatapb.Filter, send func([]*binlogdatapb.VEvent) error) error {
+	f, err := fg.newFlow()
+	if err != nil {
+		return err
+	}
+	defer fg.endFlow(f)
+	fg.wg.Add(1)
+	defer fg.wg.Done()
+	return fg.vse.Stream(fg.ctx, startPos, filter, send)
+}
+
+// StreamRows opens Engine.StreamRows as one flow of this group.
+func (fg *FlowGroup) StreamRows(query string, lastpk []sqltypes.Value, send func(*binlogdatapb.VStreamRowsResponse) error) error {
+	f, err := fg.newFlow()
+	if err != nil {
+		return err
+	}
+	defer fg.endFlow(f)
+	fg.wg.Add(1)
+	defer fg.wg.Done()
+	return fg.vse.StreamRows(fg.ctx, query, lastpk, send)
+}
+
+// StreamResults opens Engine.StreamResults as one flow of this group.
+func (fg *FlowGroup) StreamResults(query string, send func(*binlogdatapb.VStreamResultsResponse) error) error {
+	f, err := fg.newFlow()
+	if err != nil {
+		return err
+	}
+	defer fg.endFlow(f)
+	fg.wg.Add(1)
+	defer fg.wg.Done()
+	return fg.vse.StreamResults(fg.ctx, query, send)
+}
+
+// Close cancels all of this group's flows and waits for them to end.
+func (fg *FlowGroup) Close() {
+	fg.mu.Lock()
+	if fg.closed {
+		fg.mu.Unlock()
+		return
+	}
+	fg.closed = true
+	fg.mu.Unlock()
+
+	fg.cancel()
+	fg.wg.Wait()
+
+	fg.vse.mu.Lock()
+	delete(fg.vse.flowGroups, fg.id)
+	fg.vse.mu.Unlock()
+}
+
+// flowGroupInfo is the JSON shape served by /debug/vstream_flow_groups.
+type flowGroupInfo struct {
+	ID    int `json:"id"`
+	Flows int `json:"flows"`
+}
+
+// serveFlowGroupsHTTP lists open flow groups and their live flow counts.
+func (vse *Engine) serveFlowGroupsHTTP(response http.ResponseWriter, request *http.Request) {
+	if err := acl.CheckAccessHTTP(request, acl.DEBUGGING); err != nil {
+		acl.SendError(response, err)
+		return
+	}
+	vse.mu.Lock()
+	infos := make([]flowGroupInfo, 0, len(vse.flowGroups))
+	for id, fg := range vse.flowGroups {
+		fg.mu.Lock()
+		infos = append(infos, flowGroupInfo{ID: id, Flows: len(fg.flows)})
+		fg.mu.Unlock()
+	}
+	vse.mu.Unlock()
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		response.Write([]byte(err.Error()))
+		return
+	}
+	response.Write(data)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFlowGroup(maxFlows int) *FlowGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FlowGroup{
+		ctx:      ctx,
+		cancel:   cancel,
+		flows:    make(map[int]*flow),
+		admitted: make(chan struct{}, maxFlows),
+	}
+}
+
+// TestFlowGroupNewFlowBlocksPastLimit verifies newFlow provides real
+// admission control: once the group's limit of flows (2 here) are
+// outstanding, a further newFlow call blocks until one of them ends.
+func TestFlowGroupNewFlowBlocksPastLimit(t *testing.T) {
+	fg := newTestFlowGroup(2)
+
+	f1, err := fg.newFlow()
+	require.NoError(t, err)
+	f2, err := fg.newFlow()
+	require.NoError(t, err)
+
+	admittedThird := make(chan struct{})
+	go func() {
+		f3, err := fg.newFlow()
+		require.NoError(t, err)
+		fg.endFlow(f3)
+		close(admittedThird)
+	}()
+
+	select {
+	case <-admittedThird:
+		t.Fatal("newFlow should have blocked while 2 flows are outstanding")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fg.endFlow(f1)
+
+	select {
+	case <-admittedThird:
+	case <-time.After(time.Second):
+		t.Fatal("newFlow should have been admitted after endFlow freed a slot")
+	}
+
+	fg.endFlow(f2)
+}
+
+// TestFlowGroupNewFlowUnblocksOnCancel verifies a blocked newFlow returns
+// promptly once the group's context is cancelled, instead of hanging
+// forever.
+func TestFlowGroupNewFlowUnblocksOnCancel(t *testing.T) {
+	fg := newTestFlowGroup(1)
+	f1, err := fg.newFlow()
+	require.NoError(t, err)
+	defer fg.endFlow(f1)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := fg.newFlow()
+		errCh <- err
+	}()
+
+	fg.cancel()
+
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("newFlow should have returned after the group was cancelled")
+	}
+}
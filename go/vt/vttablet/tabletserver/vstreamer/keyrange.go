@@ -0,0 +1,213 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"vitess.io/vitess/go/stats"
+	"vitess.io/vitess/go/vt/key"
+	"vitess.io/vitess/go/vt/log"
+	"vitess.io/vitess/go/vt/srvtopo"
+	"vitess.io/vitess/go/vt/vtgate/vindexes"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+)
+
+// filterSkips counts binlog rows that per-row filtering was able to skip
+// purely from keyrangeIndex coverage, via Engine.SkipRowForKeyrange, without
+// running the generic vindex filter evaluator.
+var filterSkips = stats.NewCounter("VStreamFilterSkips", "Count of binlog rows skipped by keyrange coverage before vindex filter evaluation")
+
+// keyrangeEntry is one covered interval for a table: the sharding key range
+// [start, end) that a shard serving table's keyspace owns, per the table's
+// primary vindex.
+type keyrangeEntry struct {
+	start, end []byte
+}
+
+// keyrangeIndex is a sorted, immutable index of every table's primary
+// vindex coverage for one keyspace, built once per vschema version. Readers
+// snapshot a *keyrangeIndex (via localVSchema.KeyrangeIndex) under vse.mu
+// and then look up in it lock-free, since it's never mutated after
+// buildKeyrangeIndex returns.
+//
+// Entries are grouped by table name rather than kept in one flat sorted
+// slice: every table in a sharded keyspace is present on every shard, so
+// different tables' covered ranges fully overlap and a single cross-table
+// sort would make Lookup's binary search return an arbitrary table instead
+// of the one the caller asked about.
+type keyrangeIndex struct {
+	// byTable holds, for each table name with precisely known coverage, its
+	// shard ranges sorted by start. A table absent from byTable has unknown
+	// coverage (see Lookup).
+	byTable map[string][]keyrangeEntry
+}
+
+// buildKeyrangeIndex walks every table of keyspace in vschema and returns
+// the resulting index; tables of other keyspaces are not indexed. It fetches the keyspace's current shard
+// layout from ts once (not per table) to expand uniform-keyspace-id
+// vindexes (hash, binary_md5, ...) into their real per-shard coverage;
+// tables using any other vindex, or a keyspace with no reachable shard
+// layout yet, are left with unknown coverage. vschema may be nil (e.g.
+// before the first successful watch callback), in which case an empty
+// index is returned.
+func buildKeyrangeIndex(ctx context.Context, ts srvtopo.Server, cell, keyspace string, vschema *vindexes.VSchema) *keyrangeIndex {
+	kri := &keyrangeIndex{byTable: make(map[string][]keyrangeEntry)}
+	if vschema == nil {
+		return kri
+	}
+	shardRanges := fetchShardKeyRanges(ctx, ts, cell, keyspace)
+	for ksName, ks := range vschema.Keyspaces {
+		if ks == nil || ksName != keyspace {
+			continue
+		}
+		for name, table := range ks.Tables {
+			entries, known := expandTable(table, shardRanges)
+			if !known {
+				// Leave name out of byTable entirely: Lookup's "not
+				// present" case already means "coverage unknown, fall
+				// back", so there's no need for an in-band sentinel entry
+				// that could be mistaken for real (if vacuous) coverage.
+				continue
+			}
+			sort.Slice(entries, func(i, j int) bool {
+				return bytes.Compare(entries[i].start, entries[j].start) < 0
+			})
+			kri.byTable[name] = entries
+		}
+	}
+	return kri
+}
+
+// fetchShardKeyRanges returns the keyrange owned by every shard currently
+// serving keyspace's primary traffic, used to expand uniform-keyspace-id
+// vindexes into real coverage. A failure (no SrvKeyspace yet, ts is nil in
+// tests, etc.) just means expandTable falls back to unknown coverage for
+// this vschema version; the next WatchSrvVSchema callback retries.
+func fetchShardKeyRanges(ctx context.Context, ts srvtopo.Server, cell, keyspace string) []*topodatapb.KeyRange {
+	if ts == nil || keyspace == "" {
+		return nil
+	}
+	sk, err := ts.GetSrvKeyspace(ctx, cell, keyspace)
+	if err != nil {
+		log.Errorf("Error fetching shard layout for keyspace %s, falling back to unknown keyrange coverage: %v", keyspace, err)
+		return nil
+	}
+	if sk == nil {
+		return nil
+	}
+	var ranges []*topodatapb.KeyRange
+	for _, partition := range sk.GetPartitions() {
+		if partition.GetServedType() != topodatapb.TabletType_PRIMARY {
+			continue
+		}
+		for _, ref := range partition.GetShardReferences() {
+			ranges = append(ranges, ref.GetKeyRange())
+		}
+	}
+	return ranges
+}
+
+// uniformKeyspaceIDVindexes names the primary vindex types whose Map output
+// is a keyspace_id directly comparable against shard KeyRange boundaries,
+// so shard boundaries alone are enough to derive exact table coverage.
+// Lookup vindexes (consistent_lookup and friends) aren't included: their
+// Map output depends on an external lookup table, not just the input value,
+// so there's no way to derive their coverage from topology alone.
+var uniformKeyspaceIDVindexes = map[string]bool{
+	"hash":                 true,
+	"binary":               true,
+	"binary_md5":           true,
+	"unicode_loose_md5":    true,
+	"unicode_loose_xxhash": true,
+}
+
+// expandTable returns table's covered keyrange entries and whether its
+// coverage is known at all. A table whose primary vindex is one of
+// uniformKeyspaceIDVindexes expands to one entry per shard in shardRanges;
+// everything else (lookup vindexes, or no shard layout available yet)
+// reports known=false, so Lookup callers know to re-run the full filter
+// evaluator for it.
+func expandTable(table *vindexes.Table, shardRanges []*topodatapb.KeyRange) (entries []keyrangeEntry, known bool) {
+	if !hasUniformKeyspaceIDVindex(table) || len(shardRanges) == 0 {
+		return nil, false
+	}
+	entries = make([]keyrangeEntry, 0, len(shardRanges))
+	for _, kr := range shardRanges {
+		entries = append(entries, keyrangeEntry{start: kr.GetStart(), end: kr.GetEnd()})
+	}
+	return entries, true
+}
+
+// hasUniformKeyspaceIDVindex reports whether table's primary (first
+// column) vindex is one of uniformKeyspaceIDVindexes.
+func hasUniformKeyspaceIDVindex(table *vindexes.Table) bool {
+	if table == nil || len(table.ColumnVindexes) == 0 {
+		return false
+	}
+	v := table.ColumnVindexes[0].Vindex
+	if v == nil || !v.IsUnique() {
+		return false
+	}
+	return uniformKeyspaceIDVindexes[table.ColumnVindexes[0].Type]
+}
+
+// Lookup reports whether keyspaceID falls within tableName's known
+// coverage (within), and whether that coverage is precisely known at all
+// (exact). Either being false means "fall back to the generic filter
+// evaluator for this row": exact is false when tableName has no entry in
+// the index; within is false (with exact true) when keyspaceID fell outside
+// every one of tableName's shard ranges, which should not normally happen
+// for a uniform-keyspace-id vindex and indicates stale shard layout.
+func (kri *keyrangeIndex) Lookup(tableName string, keyspaceID []byte) (within, exact bool) {
+	if kri == nil {
+		return false, false
+	}
+	entries, ok := kri.byTable[tableName]
+	if !ok {
+		return false, false
+	}
+	i := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].start, keyspaceID) > 0
+	})
+	if i == 0 {
+		return false, true
+	}
+	e := entries[i-1]
+	return key.KeyRangeContains(&topodatapb.KeyRange{Start: e.start, End: e.end}, keyspaceID), true
+}
+
+// SkipRowForKeyrange reports whether a row of tableName with the given
+// keyspaceID can be skipped for wantRange purely from keyrangeIndex
+// coverage, without running the generic per-row vindex filter evaluator.
+// It's the integration point a per-row filter path (newVStreamer/
+// newRowStreamer's row loop) would call once they exist in this checkout;
+// it isn't called from one yet, since that code isn't present here.
+func (vse *Engine) SkipRowForKeyrange(kri *keyrangeIndex, tableName string, keyspaceID []byte, wantRange *topodatapb.KeyRange) bool {
+	within, exact := kri.Lookup(tableName, keyspaceID)
+	if !exact {
+		return false
+	}
+	skip := within && !key.KeyRangeContains(wantRange, keyspaceID)
+	if skip {
+		filterSkips.Add(1)
+	}
+	return skip
+}
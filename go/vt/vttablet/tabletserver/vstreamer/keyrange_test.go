@@ -0,0 +1,87 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+)
+
+func twoShardIndex() *keyrangeIndex {
+	return &keyrangeIndex{byTable: map[string][]keyrangeEntry{
+		"sharded_tbl": {
+			{start: nil, end: []byte{0x80}},
+			{start: []byte{0x80}, end: nil},
+		},
+	}}
+}
+
+func TestKeyrangeIndexLookupExactCoverage(t *testing.T) {
+	kri := twoShardIndex()
+
+	within, exact := kri.Lookup("sharded_tbl", []byte{0x40})
+	assert.True(t, exact)
+	assert.True(t, within)
+
+	within, exact = kri.Lookup("sharded_tbl", []byte{0xc0})
+	assert.True(t, exact)
+	assert.True(t, within)
+}
+
+func TestKeyrangeIndexLookupUnknownTable(t *testing.T) {
+	kri := twoShardIndex()
+
+	_, exact := kri.Lookup("no_such_tbl", []byte{0x01})
+	assert.False(t, exact)
+}
+
+func TestExpandTableFallsBackWithoutShardRanges(t *testing.T) {
+	entries, known := expandTable(nil, nil)
+	assert.Nil(t, entries)
+	assert.False(t, known)
+}
+
+func TestSkipRowForKeyrangeSkipsOutOfRangeRow(t *testing.T) {
+	vse := &Engine{}
+	kri := twoShardIndex()
+
+	// wantRange is the lower shard ("-80"); a row whose keyspace id falls in
+	// the upper shard can be skipped without running the full filter.
+	wantRange := &topodatapb.KeyRange{Start: nil, End: []byte{0x80}}
+
+	before := filterSkips.Get()
+	skip := vse.SkipRowForKeyrange(kri, "sharded_tbl", []byte{0xc0}, wantRange)
+	assert.True(t, skip)
+	assert.Equal(t, before+1, filterSkips.Get())
+
+	skip = vse.SkipRowForKeyrange(kri, "sharded_tbl", []byte{0x40}, wantRange)
+	assert.False(t, skip)
+}
+
+func TestSkipRowForKeyrangeNeverSkipsUnknownCoverage(t *testing.T) {
+	vse := &Engine{}
+	kri := twoShardIndex()
+	wantRange := &topodatapb.KeyRange{Start: nil, End: []byte{0x80}}
+
+	before := filterSkips.Get()
+	skip := vse.SkipRowForKeyrange(kri, "no_such_tbl", []byte{0xc0}, wantRange)
+	assert.False(t, skip)
+	assert.Equal(t, before, filterSkips.Get())
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vstreamer
+
+import (
+	"vitess.io/vitess/go/vt/srvtopo"
+	"vitess.io/vitess/go/vt/vtgate/vindexes"
+)
+
+// localVSchema is Engine's snapshot of the current vschema for its
+// keyspace. A new one is built and swapped in by setWatch on every vschema
+// update; once built it is immutable, so readers that grab a pointer to it
+// under vse.mu can use it lock-free afterward.
+type localVSchema struct {
+	keyspace string
+	vschema  *vindexes.VSchema
+
+	// ts and cell record where this vschema version's shard layout came
+	// from; nothing reads them back today (krIndex is always precomputed
+	// by the time a *localVSchema is published, see KeyrangeIndex below),
+	// but setWatch still fills them in so a future reader rebuilding the
+	// index for a newer keyspace/cell doesn't have to thread them through
+	// separately.
+	ts   srvtopo.Server
+	cell string
+
+	// krIndex is the sorted keyrange coverage index for this vschema
+	// version, always built by setWatch (or NewEngine, for the zero-value
+	// localVSchema that precedes the first watch callback) alongside
+	// vschema itself, never mutated afterward. Building it eagerly rather
+	// than lazily on first KeyrangeIndex call means the *localVSchema
+	// handed to concurrent streamer goroutines is safe to read lock-free,
+	// with no nil-check-then-write race to guard against.
+	krIndex *keyrangeIndex
+}
+
+// KeyrangeIndex returns the keyrange coverage index for this vschema
+// version. It's always precomputed by the time a *localVSchema is
+// reachable from a streamer, so this is just a plain field read.
+func (lvs *localVSchema) KeyrangeIndex() *keyrangeIndex {
+	return lvs.krIndex
+}